@@ -2,8 +2,11 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/gob"
+	"flag"
 	"fmt"
 	"internal/common"
 	"log"
@@ -13,7 +16,8 @@ import (
 	"strings"
 )
 
-// Message structure that represents messages sent between clients.
+// Message structure that represents messages sent between clients, or, when
+// To starts with "#", a message broadcast to everyone in that room.
 type Message struct {
 	To      string
 	From    string
@@ -21,14 +25,37 @@ type Message struct {
 	Error   bool
 }
 
+// Command structure that represents a room management request sent by a
+// client: "join" or "leave" a room, or "rooms" to list the rooms this client
+// belongs to.
+type Command struct {
+	Action string
+	Room   string
+}
+
+// RoomList structure sent by the server in reply to a "rooms" Command.
+type RoomList struct {
+	Rooms []string
+}
+
 /*
 * Establishes a connection with the server.
 * Sends the client's username and waits for the
-* server reply. Upon success, returns a TCP
-* connection that is used for sending messages.
+* server reply. Upon success, returns a connection
+* (plain TCP, or TLS when tlsConfig is non-nil) that
+* is used for sending messages.
  */
-func setup_connection(username string, ip string, port uint16) net.Conn {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", ip, port))
+func setup_connection(username string, ip string, port uint16, tlsConfig *tls.Config) net.Conn {
+	addr := fmt.Sprintf("%s:%d", ip, port)
+
+	var conn net.Conn
+	var err error
+
+	if tlsConfig != nil {
+		conn, err = tls.Dial("tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
 
 	if err != nil {
 		log.Fatal(err)
@@ -50,60 +77,79 @@ func setup_connection(username string, ip string, port uint16) net.Conn {
 	return conn
 }
 
+// Utility function that gob-encodes a frame body and writes it to conn under
+// the given frame type.
+func send_frame(conn net.Conn, msgType uint8, body interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(body); err != nil {
+		return err
+	}
+
+	return common.WriteFrame(conn, msgType, buf.Bytes())
+}
+
 // Utility function that popualates a message with
 // to and content fields and sends it to the server.
 func send_message(conn net.Conn, to string, message string) {
-	enc := gob.NewEncoder(conn)
-	err := enc.Encode(Message{to, "", message, false})
+	err := send_frame(conn, common.FrameTypeMessage, Message{to, "", message, false})
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-// Receives error messages from the server and
-// displays their content to the user.
-func receive_error(conn net.Conn) {
-	var error_length uint16
-	err := binary.Read(conn, binary.BigEndian, &error_length)
-
+// Utility function that sends a join/leave/rooms command to the server.
+func send_command(conn net.Conn, action string, room string) {
+	err := send_frame(conn, common.FrameTypeCommand, Command{action, room})
 	if err != nil {
-		fmt.Println(err)
-		return
-	}
-
-	raw_data := make([]byte, error_length)
-	_, err = conn.Read(raw_data)
-
-	if err != nil {
-		fmt.Println(err)
-		return
+		log.Fatal(err)
 	}
-
-	fmt.Fprint(common.ColorOutput, common.ErrorColor(string(raw_data)))
 }
 
 /*
-* Processes messages received from clients and servers.
-* In the case of an error message received from the server
-* prints the messages content. In the case of a message received from
-* a source client prints the sourceclient's username as well as the
-* message content.
+* Processes frames received from the server. A Message frame prints the
+* source client's username and content (or, if Error is set, prints the
+* content as an error). A RoomList frame prints the rooms this client belongs
+* to, in reply to a "/rooms" command.
  */
 func receive_messages(conn net.Conn) {
 	for {
-		dec := gob.NewDecoder(conn)
-		var msg Message
-		err := dec.Decode(&msg)
+		msgType, raw, err := common.ReadFrame(conn)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		if msg.Error {
-			fmt.Fprint(common.ColorOutput, common.ErrorColor(string(msg.Content)))
-			continue
+		// Each frame is encoded by its own gob.Encoder (see send_frame), so
+		// gob type IDs are only valid within that frame's body: a decoder
+		// reused across frames would see the same type ID redefined on the
+		// second frame of a given type and fail with "gob: duplicate type
+		// received". A fresh decoder per frame keeps decode state scoped to
+		// the frame it belongs to.
+		dec := gob.NewDecoder(bytes.NewReader(raw))
+
+		switch msgType {
+		case common.FrameTypeRoomList:
+			var list RoomList
+			err = dec.Decode(&list)
+			if err == nil {
+				fmt.Fprintf(common.ColorOutput, "Rooms: %s\n", common.NameColor(strings.Join(list.Rooms, ", ")))
+			}
+		default:
+			var msg Message
+			err = dec.Decode(&msg)
+			if err == nil {
+				if msg.Error {
+					fmt.Fprint(common.ColorOutput, common.ErrorColor(string(msg.Content)))
+				} else {
+					fmt.Fprintf(common.ColorOutput, "%s: %s\n", common.NameColor(msg.From), common.MessageColor((msg.Content)))
+				}
+			}
 		}
 
-		fmt.Fprintf(common.ColorOutput, "%s: %s\n", common.NameColor(msg.From), common.MessageColor((msg.Content)))
+		common.PutFrameBuf(raw)
+
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 }
 
@@ -144,6 +190,39 @@ func handle_send_cmd(raw_cmd string, conn net.Conn) {
 	go send_message(conn, to, message)
 }
 
+// Processes a "/join <room>" command and asks the server to add this client
+// to the room. Rooms are addressed as "#<room>" everywhere else (e.g. "send
+// #<room> <msg>"), so the leading "#" is added here for consistency.
+func handle_join_cmd(raw_cmd string, conn net.Conn) {
+	args := strings.Split(raw_cmd, " ")[1:]
+
+	if len(args) != 1 {
+		fmt.Println("Type '/join <room>' to join a room")
+		return
+	}
+
+	go send_command(conn, "join", "#"+args[0])
+}
+
+// Processes a "/leave <room>" command and asks the server to remove this
+// client from the room.
+func handle_leave_cmd(raw_cmd string, conn net.Conn) {
+	args := strings.Split(raw_cmd, " ")[1:]
+
+	if len(args) != 1 {
+		fmt.Println("Type '/leave <room>' to leave a room")
+		return
+	}
+
+	go send_command(conn, "leave", "#"+args[0])
+}
+
+// Processes a "/rooms" command and asks the server for the list of rooms
+// this client has joined.
+func handle_rooms_cmd(conn net.Conn) {
+	go send_command(conn, "rooms", "")
+}
+
 /*
 * Main thread, checks the source client's username
 * to make sure it does not exceed the maximum length.
@@ -154,14 +233,23 @@ func handle_send_cmd(raw_cmd string, conn net.Conn) {
 'quit' command is issued by the user.
 */
 func main() {
-	if len(os.Args) < 4 {
+	use_tls := flag.Bool("tls", false, "connect to the server over TLS")
+	cert_file := flag.String("cert", "", "path to a client certificate, presented to the server for pinning (implies -tls)")
+	key_file := flag.String("key", "", "path to the private key matching -cert")
+	ca_file := flag.String("ca", "", "path to a CA bundle used to verify the server's certificate")
+	insecure_skip_verify := flag.Bool("insecure-skip-verify", false, "skip verification of the server's certificate (dangerous, for testing only)")
+	flag.Parse()
+
+	args := flag.Args()
+
+	if len(args) < 3 {
 		fmt.Println("Need to supply arguments: server ip, port, and username")
 		return
 	}
 
-	server_ip := os.Args[1]
-	username := os.Args[3]
-	server_port, err := strconv.Atoi(os.Args[2])
+	server_ip := args[0]
+	username := args[2]
+	server_port, err := strconv.Atoi(args[1])
 
 	if err != nil {
 		panic(err)
@@ -172,7 +260,15 @@ func main() {
 		return
 	}
 
-	conn := setup_connection(username, server_ip, uint16(server_port))
+	var tls_config *tls.Config
+	if *use_tls || *cert_file != "" || *ca_file != "" {
+		tls_config, err = common.BuildClientTLSConfig(*cert_file, *key_file, *ca_file, *insecure_skip_verify)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	conn := setup_connection(username, server_ip, uint16(server_port), tls_config)
 	defer conn.Close()
 
 	fmt.Fprintf(common.ColorOutput, "Connected with username %s\n", common.NameColor(username))
@@ -186,10 +282,16 @@ func main() {
 
 		if raw_cmd == "exit" {
 			os.Exit(0)
+		} else if raw_cmd == "/rooms" {
+			handle_rooms_cmd(conn)
+		} else if strings.HasPrefix(raw_cmd, "/join ") {
+			handle_join_cmd(raw_cmd, conn)
+		} else if strings.HasPrefix(raw_cmd, "/leave ") {
+			handle_leave_cmd(raw_cmd, conn)
 		} else if strings.HasPrefix(raw_cmd, "send") {
 			handle_send_cmd(raw_cmd, conn)
 		} else {
-			fmt.Println("Unrecognized command. Type 'send <username> <message>' or 'exit'")
+			fmt.Println("Unrecognized command. Type 'send <username|#room> <message>', '/join <room>', '/leave <room>', '/rooms', or 'exit'")
 		}
 	}
 }
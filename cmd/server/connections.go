@@ -0,0 +1,55 @@
+package main
+
+import "sync"
+
+/*
+ConnTable is the server's live username -> Connection table. It's guarded by
+a mutex because it's read and written from many goroutines at once: one
+receive_messages goroutine per TCP client, one HTTP handler goroutine per
+websocket gateway connection, listen_for_connections, and the single
+process_message_queue router.
+*/
+type ConnTable struct {
+	mu    sync.Mutex
+	conns map[string]Connection
+}
+
+// NewConnTable returns an empty, ready-to-use ConnTable.
+func NewConnTable() *ConnTable {
+	return &ConnTable{conns: make(map[string]Connection)}
+}
+
+// Get returns the connection registered for username, if any.
+func (c *ConnTable) Get(username string) (Connection, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	conn, ok := c.conns[username]
+	return conn, ok
+}
+
+/*
+Register atomically checks that conn's username isn't already taken and, if
+not, registers conn under it. Returns false (without registering conn) if the
+username is already in use, so callers don't need a separate check-then-set
+that could race with another goroutine registering the same username.
+*/
+func (c *ConnTable) Register(conn Connection) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, taken := c.conns[conn.username]; taken {
+		return false
+	}
+
+	c.conns[conn.username] = conn
+	return true
+}
+
+// Delete removes username's connection, if any.
+func (c *ConnTable) Delete(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.conns, username)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"internal/common"
+	"internal/federation"
+	"net"
+)
+
+// forward_message sends msg to nodeID over a persistent TCP connection
+// cached by cluster, dialing addr if there isn't one cached yet. The
+// connection is dropped (so the next attempt reconnects) if the write
+// fails.
+func forward_message(cluster *federation.Cluster, nodeID string, addr string, msg Message) error {
+	conn, err := cluster.Dial(nodeID, addr)
+	if err != nil {
+		return err
+	}
+
+	if err := send_frame(conn, common.FrameTypeMessage, msg); err != nil {
+		cluster.Drop(nodeID)
+		return err
+	}
+
+	return nil
+}
+
+/*
+listen_for_federated_connections accepts the persistent TCP connections
+peer nodes forward messages over, and re-enters each received Message into
+this node's own message queue as if it had arrived from a local client.
+There's no handshake: a node's forwarding port is only ever dialed by peers
+it already gossips with.
+*/
+func listen_for_federated_connections(ln net.Listener, mq chan<- Message) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		go receive_federated_messages(conn, mq)
+	}
+}
+
+func receive_federated_messages(conn net.Conn, mq chan<- Message) {
+	defer conn.Close()
+
+	for {
+		_, raw, err := common.ReadFrame(conn)
+		if err != nil {
+			return
+		}
+
+		// Each frame is encoded by its own gob.Encoder (see send_frame), so
+		// gob type IDs are only valid within that frame's body: a decoder
+		// reused across frames would see the same type ID redefined on the
+		// second frame of a given type and fail with "gob: duplicate type
+		// received". A fresh decoder per frame keeps decode state scoped to
+		// the frame it belongs to.
+		dec := gob.NewDecoder(bytes.NewReader(raw))
+
+		var msg Message
+		err = dec.Decode(&msg)
+		common.PutFrameBuf(raw)
+		if err != nil {
+			return
+		}
+
+		mq <- msg
+	}
+}
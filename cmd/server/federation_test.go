@@ -0,0 +1,44 @@
+package main
+
+import (
+	"internal/common"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestReceiveFederatedMessagesSurvivesMultipleFrames checks that
+// receive_federated_messages can decode more than one forwarded Message off
+// the same connection. Each frame is gob-encoded by its own encoder (see
+// send_frame), so a decoder reused across frames fails with "gob: duplicate
+// type received" on the second frame of a given type — which used to kill
+// federation forwarding after exactly one message per inter-node connection.
+func TestReceiveFederatedMessagesSurvivesMultipleFrames(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	mq := make(chan Message, 2)
+	go receive_federated_messages(server, mq)
+
+	want := []Message{
+		{To: "bob", From: "alice", Content: "first"},
+		{To: "bob", From: "alice", Content: "second"},
+	}
+
+	for _, msg := range want {
+		if err := send_frame(client, common.FrameTypeMessage, msg); err != nil {
+			t.Fatalf("send_frame: %v", err)
+		}
+	}
+
+	for i, wantMsg := range want {
+		select {
+		case got := <-mq:
+			if got != wantMsg {
+				t.Fatalf("message %d = %+v, want %+v", i, got, wantMsg)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+/*
+FingerprintStore persists SHA-256 client certificate fingerprint -> username
+bindings to a JSON file so that a client presenting a pinned certificate is
+bound to the same username across restarts, preventing a stolen username from
+being impersonated by someone without the matching keypair.
+*/
+type FingerprintStore struct {
+	mu       sync.Mutex
+	path     string
+	bindings map[string]string // fingerprint -> username
+}
+
+// LoadFingerprintStore reads the JSON binding file at path if it exists, or
+// starts with an empty store if the file does not exist yet.
+func LoadFingerprintStore(path string) (*FingerprintStore, error) {
+	store := &FingerprintStore{path: path, bindings: make(map[string]string)}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(raw, &store.bindings); err != nil {
+		return nil, fmt.Errorf("failed to parse fingerprint store %s: %w", path, err)
+	}
+
+	return store, nil
+}
+
+/*
+Bind records that fingerprint owns username, persisting the updated store to
+disk. Returns an error if the fingerprint is already bound to a different
+username (so a stolen username can't be claimed by a second keypair) or if
+username is already bound to a different fingerprint (so a second keypair
+can't claim a username already pinned to someone else's certificate).
+*/
+func (s *FingerprintStore) Bind(fingerprint string, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.bindings[fingerprint]; ok && existing != username {
+		return fmt.Errorf("certificate is already bound to user %s", existing)
+	}
+
+	for fp, bound := range s.bindings {
+		if bound == username && fp != fingerprint {
+			return fmt.Errorf("user %s is already bound to a different certificate", username)
+		}
+	}
+
+	s.bindings[fingerprint] = username
+	return s.save()
+}
+
+// Username returns the username bound to fingerprint, if any.
+func (s *FingerprintStore) Username(fingerprint string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	username, ok := s.bindings[fingerprint]
+	return username, ok
+}
+
+// UsernameBound reports whether username is already bound to some
+// fingerprint, regardless of which one.
+func (s *FingerprintStore) UsernameBound(username string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, bound := range s.bindings {
+		if bound == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *FingerprintStore) save() error {
+	raw, err := json.MarshalIndent(s.bindings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(s.path, raw, 0600)
+}
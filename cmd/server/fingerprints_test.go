@@ -0,0 +1,61 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func newTestFingerprintStore(t *testing.T) *FingerprintStore {
+	t.Helper()
+
+	store, err := LoadFingerprintStore(filepath.Join(t.TempDir(), "fingerprints.json"))
+	if err != nil {
+		t.Fatalf("LoadFingerprintStore: %v", err)
+	}
+	return store
+}
+
+func TestBindSameFingerprintAndUsernameIsIdempotent(t *testing.T) {
+	store := newTestFingerprintStore(t)
+
+	if err := store.Bind("fingerprintA", "alice"); err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+	if err := store.Bind("fingerprintA", "alice"); err != nil {
+		t.Fatalf("repeated Bind of the same pair: %v", err)
+	}
+}
+
+func TestBindRejectsFingerprintReboundToDifferentUsername(t *testing.T) {
+	store := newTestFingerprintStore(t)
+
+	if err := store.Bind("fingerprintA", "alice"); err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+
+	if err := store.Bind("fingerprintA", "mallory"); err == nil {
+		t.Fatal("Bind let a second username claim a fingerprint already bound to someone else")
+	}
+}
+
+// TestBindRejectsUsernameClaimedByDifferentFingerprint is the reverse of the
+// existing fingerprint-reuse check: a second certificate must not be able to
+// claim a username already pinned to someone else's certificate.
+func TestBindRejectsUsernameClaimedByDifferentFingerprint(t *testing.T) {
+	store := newTestFingerprintStore(t)
+
+	if err := store.Bind("fingerprintA", "alice"); err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+
+	if err := store.Bind("fingerprintB", "alice"); err == nil {
+		t.Fatal("Bind let a second certificate claim a username already bound to a different fingerprint")
+	}
+
+	if got, ok := store.Username("fingerprintA"); !ok || got != "alice" {
+		t.Fatalf("original binding should be unchanged, got (%q, %v)", got, ok)
+	}
+	if _, ok := store.Username("fingerprintB"); ok {
+		t.Fatal("fingerprintB should not have been bound")
+	}
+}
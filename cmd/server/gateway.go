@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"internal/common"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// wsFrame is the JSON shape a browser client exchanges with the gateway over
+// its websocket: To addresses a username or, prefixed with "#", a room.
+// Error marks a frame as a notice from the server rather than a chat message.
+// Action and Room, if Action is set, make this an outgoing join/leave/rooms
+// Command instead of a chat message (mirroring cmd/client's send_command);
+// the server never sends a frame with Action set.
+type wsFrame struct {
+	To      string `json:"to"`
+	From    string `json:"from,omitempty"`
+	Content string `json:"content"`
+	Error   bool   `json:"error,omitempty"`
+	Action  string `json:"action,omitempty"`
+	Room    string `json:"room,omitempty"`
+}
+
+/*
+wsConn adapts a *websocket.Conn to the net.Conn interface so a browser
+client's websocket drops into the exact same Connection, write_loop, and
+receive_messages path used for plain TCP clients. The framed protocol those
+functions speak (a {msgType, length} header followed by a gob-encoded body)
+isn't something browser JavaScript can decode, so wsConn translates at the
+boundary: outgoing frames are decoded from gob and re-sent as JSON websocket
+messages, and incoming JSON messages are re-encoded as gob and synthesized
+back into a framed byte stream.
+
+This relies on common.WriteFrame always writing a frame as exactly two
+Write calls (the whole header, then the whole body), which is how every
+writer in this codebase uses it.
+*/
+type wsConn struct {
+	ws *websocket.Conn
+
+	header_pending bool
+	pending_type   uint8
+
+	read_buf []byte
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if !c.header_pending {
+		if len(p) != 5 {
+			return 0, fmt.Errorf("gateway: expected a 5-byte frame header, got %d bytes", len(p))
+		}
+
+		c.pending_type = p[0]
+		c.header_pending = true
+		return len(p), nil
+	}
+
+	c.header_pending = false
+	if err := c.send_json(c.pending_type, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// send_json decodes a gob-encoded frame body and forwards its content to the
+// browser as a JSON websocket message.
+func (c *wsConn) send_json(msg_type uint8, body []byte) error {
+	frame := wsFrame{Error: msg_type == common.FrameTypeError}
+
+	switch msg_type {
+	case common.FrameTypeRoomList:
+		var list RoomList
+		if len(body) > 0 {
+			if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&list); err != nil {
+				return err
+			}
+		}
+		frame.Content = strings.Join(list.Rooms, ", ")
+	default:
+		var msg Message
+		if len(body) > 0 {
+			if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&msg); err != nil {
+				return err
+			}
+		}
+		frame.To = msg.To
+		frame.From = msg.From
+		frame.Content = msg.Content
+		frame.Error = frame.Error || msg.Error
+	}
+
+	return c.ws.WriteJSON(frame)
+}
+
+// Read hands back the bytes of a synthetic {header, gob body} frame built
+// from the next JSON message the browser sends, reassembled across as many
+// calls as the reader needs.
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.read_buf) == 0 {
+		var incoming wsFrame
+		if err := c.ws.ReadJSON(&incoming); err != nil {
+			return 0, err
+		}
+
+		raw, err := encode_incoming_frame(incoming)
+		if err != nil {
+			return 0, err
+		}
+
+		c.read_buf = raw
+	}
+
+	n := copy(p, c.read_buf)
+	c.read_buf = c.read_buf[n:]
+	return n, nil
+}
+
+// encode_incoming_frame turns a browser wsFrame into the {header, gob body}
+// bytes receive_messages expects: a Command if Action is set (mirroring
+// cmd/client's send_command), a chat Message otherwise.
+func encode_incoming_frame(incoming wsFrame) ([]byte, error) {
+	msgType := uint8(common.FrameTypeMessage)
+	var payload interface{} = Message{To: incoming.To, Content: incoming.Content}
+	if incoming.Action != "" {
+		msgType = common.FrameTypeCommand
+		payload = Command{Action: incoming.Action, Room: incoming.Room}
+	}
+
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(payload); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 5)
+	header[0] = msgType
+	binary.BigEndian.PutUint32(header[1:], uint32(body.Len()))
+
+	return append(header, body.Bytes()...), nil
+}
+
+func (c *wsConn) Close() error                       { return c.ws.Close() }
+func (c *wsConn) LocalAddr() net.Addr                { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr               { return c.ws.RemoteAddr() }
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+/*
+serve_gateway runs an HTTP server exposing a minimal chat page at "/" and a
+websocket endpoint at "/ws". A websocket connection is registered in state's
+connections map exactly like a TCP client, so a browser user and a TCP user
+can DM each other or share a room transparently through the same rooms,
+moderation, and message-queue pipeline.
+*/
+func serve_gateway(port int, state *ServerState) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, gatewayIndexPage)
+	})
+
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		handle_ws_connection(w, r, state)
+	})
+
+	fmt.Fprintf(common.ColorOutput, "Gateway listening on :%d\n", port)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), mux))
+}
+
+// handle_ws_connection upgrades an incoming request to a websocket, checks
+// the requested username against the same length, ban, and uniqueness rules
+// a TCP connection is held to, and then registers it exactly like one.
+func handle_ws_connection(w http.ResponseWriter, r *http.Request, state *ServerState) {
+	username := r.URL.Query().Get("username")
+	if username == "" || len(username) > common.MAX_USERNAME_LENGTH {
+		http.Error(w, fmt.Sprintf("a non-empty username of at most %d characters is required", common.MAX_USERNAME_LENGTH), http.StatusBadRequest)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if state.bans.IsBanned(username, ip, "") {
+		ws.WriteJSON(wsFrame{Content: "You are banned\n", Error: true})
+		ws.Close()
+		return
+	}
+
+	if state.cluster != nil && state.cluster.OwnedByPeer(username) {
+		ws.WriteJSON(wsFrame{Content: "Username is taken\n", Error: true})
+		ws.Close()
+		return
+	}
+
+	conn := newConnection(username, &wsConn{ws: ws})
+	if !state.connections.Register(conn) {
+		ws.WriteJSON(wsFrame{Content: "Username is taken\n", Error: true})
+		ws.Close()
+		return
+	}
+
+	if state.cluster != nil {
+		state.cluster.Join(username)
+	}
+
+	fmt.Fprintf(common.ColorOutput, "User %s connected via gateway\n", common.NameColor(username))
+
+	go write_loop(conn)
+	go receive_messages(state.connections, conn, state.message_queue, state.rooms, state.cluster)
+}
+
+const gatewayIndexPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Chat</title>
+</head>
+<body>
+<div id="log" style="height: 300px; overflow-y: scroll; border: 1px solid black;"></div>
+<input id="username" placeholder="username">
+<button id="connect">Connect</button>
+<br>
+<input id="to" placeholder="to (username or #room)">
+<input id="content" placeholder="message">
+<button id="send">Send</button>
+<br>
+<input id="room" placeholder="room">
+<button id="join">Join</button>
+<button id="leave">Leave</button>
+<button id="rooms">List rooms</button>
+<script>
+var ws;
+function log(line) {
+	var div = document.getElementById("log");
+	div.innerHTML += line + "<br>";
+	div.scrollTop = div.scrollHeight;
+}
+document.getElementById("connect").onclick = function() {
+	var username = document.getElementById("username").value;
+	var proto = location.protocol === "https:" ? "wss://" : "ws://";
+	ws = new WebSocket(proto + location.host + "/ws?username=" + encodeURIComponent(username));
+	ws.onmessage = function(ev) {
+		var frame = JSON.parse(ev.data);
+		if (frame.error) {
+			log("error: " + frame.content);
+		} else {
+			log(frame.from + ": " + frame.content);
+		}
+	};
+	ws.onclose = function() { log("disconnected"); };
+};
+document.getElementById("send").onclick = function() {
+	ws.send(JSON.stringify({
+		to: document.getElementById("to").value,
+		content: document.getElementById("content").value
+	}));
+};
+function send_command(action) {
+	var room = document.getElementById("room").value;
+	if (room !== "" && room.charAt(0) !== "#") {
+		room = "#" + room;
+	}
+	ws.send(JSON.stringify({
+		action: action,
+		room: room
+	}));
+}
+document.getElementById("join").onclick = function() { send_command("join"); };
+document.getElementById("leave").onclick = function() { send_command("leave"); };
+document.getElementById("rooms").onclick = function() { send_command("rooms"); };
+</script>
+</body>
+</html>
+`
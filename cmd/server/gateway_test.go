@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"internal/common"
+	"testing"
+)
+
+// decodeGatewayFrame splits the {header, gob body} bytes encode_incoming_frame
+// produces back into a msgType and raw body, mirroring how receive_messages
+// reads off the wire.
+func decodeGatewayFrame(t *testing.T, raw []byte) (uint8, []byte) {
+	t.Helper()
+
+	if len(raw) < 5 {
+		t.Fatalf("frame too short: %d bytes", len(raw))
+	}
+	msgType := raw[0]
+	length := binary.BigEndian.Uint32(raw[1:5])
+	body := raw[5:]
+	if uint32(len(body)) != length {
+		t.Fatalf("header length %d does not match body length %d", length, len(body))
+	}
+	return msgType, body
+}
+
+func TestEncodeIncomingFrameChatMessage(t *testing.T) {
+	raw, err := encode_incoming_frame(wsFrame{To: "bob", Content: "hi"})
+	if err != nil {
+		t.Fatalf("encode_incoming_frame: %v", err)
+	}
+
+	msgType, body := decodeGatewayFrame(t, raw)
+	if msgType != common.FrameTypeMessage {
+		t.Fatalf("msgType = %d, want FrameTypeMessage", msgType)
+	}
+
+	var msg Message
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&msg); err != nil {
+		t.Fatalf("decode Message: %v", err)
+	}
+	if msg.To != "bob" || msg.Content != "hi" {
+		t.Fatalf("msg = %+v, want To=bob Content=hi", msg)
+	}
+}
+
+func TestEncodeIncomingFrameJoinCommand(t *testing.T) {
+	raw, err := encode_incoming_frame(wsFrame{Action: "join", Room: "general"})
+	if err != nil {
+		t.Fatalf("encode_incoming_frame: %v", err)
+	}
+
+	msgType, body := decodeGatewayFrame(t, raw)
+	if msgType != common.FrameTypeCommand {
+		t.Fatalf("msgType = %d, want FrameTypeCommand", msgType)
+	}
+
+	var cmd Command
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&cmd); err != nil {
+		t.Fatalf("decode Command: %v", err)
+	}
+	if cmd.Action != "join" || cmd.Room != "general" {
+		t.Fatalf("cmd = %+v, want Action=join Room=general", cmd)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"internal/common"
+	"sync"
+)
+
+/*
+Rooms maps a room name (including its leading "#") to the set of usernames
+subscribed to it. It's guarded by a mutex because it's read and written from
+many goroutines at once: one receive_messages goroutine per client (TCP or
+websocket gateway) and the single process_message_queue router.
+*/
+type Rooms struct {
+	mu      sync.Mutex
+	members map[string]map[string]Connection
+}
+
+// NewRooms returns an empty, ready-to-use Rooms.
+func NewRooms() *Rooms {
+	return &Rooms{members: make(map[string]map[string]Connection)}
+}
+
+// Join subscribes conn to room, creating the room if this is its first member.
+func (r *Rooms) Join(room string, conn Connection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	members, ok := r.members[room]
+	if !ok {
+		members = make(map[string]Connection)
+		r.members[room] = members
+	}
+
+	members[conn.username] = conn
+	fmt.Fprintf(common.ColorOutput, "User %s joined %s\n", common.NameColor(conn.username), common.NameColor(room))
+}
+
+// Leave unsubscribes username from room, removing the room entirely once it's empty.
+func (r *Rooms) Leave(room string, username string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.leaveLocked(room, username)
+}
+
+func (r *Rooms) leaveLocked(room string, username string) {
+	members, ok := r.members[room]
+	if !ok {
+		return
+	}
+
+	delete(members, username)
+	if len(members) == 0 {
+		delete(r.members, room)
+	}
+}
+
+// LeaveAll removes username from every room it belongs to, used when a client disconnects.
+func (r *Rooms) LeaveAll(username string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for room := range r.members {
+		r.leaveLocked(room, username)
+	}
+}
+
+// Names returns the rooms username currently belongs to.
+func (r *Rooms) Names(username string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0)
+	for room, members := range r.members {
+		if _, ok := members[username]; ok {
+			names = append(names, room)
+		}
+	}
+	return names
+}
+
+/*
+Members returns a snapshot of room's current members as a slice, safe for the
+caller to range over without holding Rooms' lock (e.g. while fanning a
+message out to every member, which may itself block on a full send queue).
+The bool result is false if room doesn't exist.
+*/
+func (r *Rooms) Members(room string) ([]Connection, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	members, ok := r.members[room]
+	if !ok {
+		return nil, false
+	}
+
+	out := make([]Connection, 0, len(members))
+	for _, conn := range members {
+		out = append(out, conn)
+	}
+	return out, true
+}
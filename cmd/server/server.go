@@ -2,17 +2,38 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/gob"
+	"flag"
 	"fmt"
 	"internal/common"
+	"internal/federation"
+	"internal/moderation"
 	"log"
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-// Message structure that represents messages sent between clients.
+// How long a write to a client is given to complete before that client is
+// considered slow and evicted.
+var WriteTimeout = 5 * time.Second
+
+// How many outbound frames a client may have queued before it's considered
+// slow and evicted.
+var SendQueueCapacity = 64
+
+// How often TCP keepalive probes are sent on accepted connections, so that
+// peers that vanish without closing the connection are eventually reaped.
+var KeepAlivePeriod = 30 * time.Second
+
+// Message structure that represents messages sent between clients, or, when
+// To starts with "#", a message broadcast to everyone in that room.
 type Message struct {
 	To      string
 	From    string
@@ -20,10 +41,141 @@ type Message struct {
 	Error   bool
 }
 
+// Command structure that represents a room management request sent by a
+// client: "join" or "leave" a room, or "rooms" to list the rooms it belongs to.
+type Command struct {
+	Action string
+	Room   string
+}
+
+// RoomList structure sent back to a client in reply to a "rooms" Command.
+type RoomList struct {
+	Rooms []string
+}
+
+// Utility function that gob-encodes a frame body and writes it directly to
+// conn, without going through a per-connection send queue. Used for client
+// connections only before they're registered and their writer goroutine is
+// started (e.g. rejecting a duplicate username), since nothing would ever
+// drain their queue, and for forwarding messages to peer nodes.
+func send_frame(conn net.Conn, msgType uint8, body interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(body); err != nil {
+		return err
+	}
+
+	return common.WriteFrame(conn, msgType, buf.Bytes())
+}
+
+// outboundFrame is a gob-encoded frame body waiting to be written to a
+// client by that client's writer goroutine.
+type outboundFrame struct {
+	msgType uint8
+	body    []byte
+}
+
+/*
+connState is the mutable, shared part of a Connection: whether its outbox
+has been torn down. It's guarded by its own mutex, and shared by pointer
+across every copy of a Connection (the connections table, room membership
+snapshots, goroutine closures, ...), so that closing outbox and sending on
+it can never race with each other no matter which copy either side is
+holding. Without this, a goroutine could see a stale "connected" snapshot,
+race another goroutine's close(outbox), and send on a closed channel, which
+panics even inside a select/default.
+*/
+type connState struct {
+	mu     sync.Mutex
+	closed bool
+}
+
+// send enqueues frame on outbox, returning false without sending if outbox
+// is already closed or already full.
+func (s *connState) send(outbox chan<- outboundFrame, frame outboundFrame) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	select {
+	case outbox <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeOnce closes outbox, unless some other caller already has.
+func (s *connState) closeOnce(outbox chan outboundFrame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(outbox)
+}
+
 // Connection structure that represents a 1 to 1 connection between server and client.
 type Connection struct {
 	username string
 	conn     net.Conn
+	outbox   chan outboundFrame
+	state    *connState
+}
+
+// newConnection builds a Connection wrapping netConn, with a fresh outbox
+// and connState.
+func newConnection(username string, netConn net.Conn) Connection {
+	return Connection{username, netConn, make(chan outboundFrame, SendQueueCapacity), &connState{}}
+}
+
+/*
+enqueue gob-encodes body and queues it for conn's writer goroutine to
+deliver. If conn's send queue is already full, or conn has already been
+torn down by its receive_messages cleanup, conn is evicted (or, if already
+gone, simply dropped) rather than blocking the router on a slow reader or
+sending on a closed channel.
+*/
+func enqueue(conn Connection, msgType uint8, body interface{}) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(body); err != nil {
+		log.Fatal(err)
+	}
+
+	if !conn.state.send(conn.outbox, outboundFrame{msgType, buf.Bytes()}) {
+		fmt.Fprintf(common.ColorOutput, "User %s fell behind or already disconnected, dropping\n", common.NameColor(conn.username))
+		conn.conn.Close()
+	}
+}
+
+/*
+write_loop is the dedicated writer goroutine for a single client. It pulls
+frames off conn's outbox and writes them one at a time, bounding each write
+with WriteTimeout so a client that stops reading can't stall the goroutine
+forever. A write that times out (or otherwise fails) evicts the client by
+closing its connection, which unblocks the matching receive_messages call so
+it can run the usual disconnect cleanup.
+*/
+func write_loop(conn Connection) {
+	for frame := range conn.outbox {
+		conn.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+
+		if err := common.WriteFrame(conn.conn, frame.msgType, frame.body); err != nil {
+			fmt.Fprintf(common.ColorOutput, "User %s fell behind, dropping\n", common.NameColor(conn.username))
+			conn.conn.Close()
+			return
+		}
+	}
+}
+
+// enqueue_error queues an error frame for conn's writer goroutine to
+// deliver, evicting conn if its send queue is full.
+func enqueue_error(conn Connection, error_msg string) {
+	enqueue(conn, common.FrameTypeError, Message{"", "", error_msg, true})
 }
 
 /*
@@ -31,14 +183,28 @@ Accept a connection request and return a struct identifying the connecting user.
 When a new user connects, they send their username prefixed by a header indicating the length
 of the username. The username is rejected if the length is too high because we don't
 want malicious clients causing the server to allocate extra memory.
+
+If the connection is a TLS connection and the client presented a certificate,
+the certificate's SHA-256 fingerprint is pinned to the announced username via
+fingerprints: a fresh fingerprint is bound to the username on first use, and a
+fingerprint already bound to a different username is rejected so that a stolen
+username can't be impersonated by someone without the matching keypair. A
+client that presents no certificate at all is rejected the same way if the
+username it's claiming already has a certificate pinned to it, so that
+impersonation can't be achieved simply by skipping client auth.
+
+The connecting username, remote IP, and certificate fingerprint (if any) are
+checked against bans before the connection is accepted.
 */
-func receive_connection(ln net.Listener) (Connection, error) {
+func receive_connection(ln net.Listener, fingerprints *FingerprintStore, bans *moderation.List) (Connection, error) {
 	conn, err := ln.Accept()
 
 	if err != nil {
 		return Connection{}, err
 	}
 
+	set_keepalive(conn)
+
 	// Size of username in bytes
 	var username_size uint8
 	err = binary.Read(conn, binary.BigEndian, &username_size)
@@ -65,78 +231,194 @@ func receive_connection(ln net.Listener) (Connection, error) {
 
 	username := string(raw_data)
 
+	var fingerprint string
+	if tls_conn, ok := conn.(*tls.Conn); ok {
+		state := tls_conn.ConnectionState()
+		if len(state.PeerCertificates) > 0 {
+			fingerprint = common.CertFingerprint(state.PeerCertificates[0])
+		}
+	}
+
+	if bans.IsBanned(username, remote_ip(conn), fingerprint) {
+		conn.Close()
+		return Connection{}, fmt.Errorf("user %s is banned", username)
+	}
+
+	if fingerprints != nil {
+		if fingerprint != "" {
+			if err := fingerprints.Bind(fingerprint, username); err != nil {
+				conn.Close()
+				return Connection{}, err
+			}
+		} else if fingerprints.UsernameBound(username) {
+			// A certificate is already pinned to this username: a connection
+			// with no client certificate at all can't be that keyholder, so
+			// refuse to let it claim the username instead of silently
+			// treating "no cert" the same as "unrecognized cert".
+			conn.Close()
+			return Connection{}, fmt.Errorf("user %s requires a pinned client certificate", username)
+		}
+	}
+
 	fmt.Fprintf(common.ColorOutput, "User %s connected\n", common.NameColor(username))
-	return Connection{username, conn}, nil
+	return newConnection(username, conn), nil
+}
+
+// remote_ip returns the host portion of conn's remote address, for ban checks.
+func remote_ip(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// set_keepalive enables TCP keepalive on conn's underlying *net.TCPConn, if
+// it has one, so that a dead peer is eventually reaped even if it never
+// sends a FIN. conn may be a plain TCP connection or a TLS connection
+// wrapping one.
+func set_keepalive(conn net.Conn) {
+	tcp_conn, ok := conn.(*net.TCPConn)
+	if !ok {
+		if tls_conn, ok := conn.(*tls.Conn); ok {
+			tcp_conn, ok = tls_conn.NetConn().(*net.TCPConn)
+			if !ok {
+				return
+			}
+		} else {
+			return
+		}
+	}
+
+	tcp_conn.SetKeepAlive(true)
+	tcp_conn.SetKeepAlivePeriod(KeepAlivePeriod)
 }
 
 /*
-* A function that runs continously, decodes
-* messages received from source clients and validates
-* the username and message content. Upon successful
-* validation, puts the message in the server's message queue.
+* A function that runs continously, reads framed messages and commands from
+* a source client and validates the username and message content. Message
+* frames are, upon successful validation, put in the server's message queue.
+* Command frames (join/leave/rooms) are applied directly to rooms since they
+* don't need to be routed anywhere.
  */
-func receive_messages(connections map[string]Connection, conn Connection, mq chan<- Message) {
+func receive_messages(connections *ConnTable, conn Connection, mq chan<- Message, rooms *Rooms, cluster *federation.Cluster) {
+loop:
 	for {
-
-		dec := gob.NewDecoder(conn.conn)
-		var msg Message
-		err := dec.Decode(&msg)
+		msgType, raw, err := common.ReadFrame(conn.conn)
 		if err != nil {
 			break
 		}
-		to_size := uint16(len(msg.To))
-		msg_size := uint16(len(msg.Content))
 
-		if to_size > uint16(common.MAX_USERNAME_LENGTH) {
-			fmt.Fprintf(
-				common.ColorOutput,
-				"User %s tried to send a message to a username of length %d. Maximum length is %d.\n",
-				common.NameColor(conn.username),
-				to_size,
-				common.MAX_USERNAME_LENGTH)
-			break
-		}
+		// Each frame is encoded by its own gob.Encoder (see send_frame), so
+		// gob type IDs are only valid within that frame's body: a decoder
+		// reused across frames would see the same type ID redefined on the
+		// second frame of a given type and fail with "gob: duplicate type
+		// received". A fresh decoder per frame keeps decode state scoped to
+		// the frame it belongs to.
+		dec := gob.NewDecoder(bytes.NewReader(raw))
+
+		switch msgType {
+		case common.FrameTypeCommand:
+			var cmd Command
+			err = dec.Decode(&cmd)
+			common.PutFrameBuf(raw)
+			if err != nil {
+				break loop
+			}
+			handle_command(rooms, conn, cmd)
+			continue
+		default:
+			var msg Message
+			err = dec.Decode(&msg)
+			common.PutFrameBuf(raw)
+			if err != nil {
+				break loop
+			}
 
-		if msg_size > uint16(common.MAX_MESSAGE_LENGTH) {
-			fmt.Fprintf(
-				common.ColorOutput,
-				"User %s tried to send a message of length %d. Maximum length is %d.\n",
-				common.NameColor(conn.username),
-				msg_size,
-				common.MAX_MESSAGE_LENGTH)
-			break
+			to_size := uint16(len(msg.To))
+			msg_size := uint16(len(msg.Content))
+
+			if to_size > uint16(common.MAX_USERNAME_LENGTH) {
+				fmt.Fprintf(
+					common.ColorOutput,
+					"User %s tried to send a message to a username of length %d. Maximum length is %d.\n",
+					common.NameColor(conn.username),
+					to_size,
+					common.MAX_USERNAME_LENGTH)
+				break loop
+			}
+
+			if msg_size > uint16(common.MAX_MESSAGE_LENGTH) {
+				fmt.Fprintf(
+					common.ColorOutput,
+					"User %s tried to send a message of length %d. Maximum length is %d.\n",
+					common.NameColor(conn.username),
+					msg_size,
+					common.MAX_MESSAGE_LENGTH)
+				break loop
+			}
+			msg.From = conn.username
+			mq <- msg
+			fmt.Fprintf(common.ColorOutput, "%s to %s: %s\n", common.NameColor(conn.username), common.NameColor(msg.To), common.MessageColor(msg.Content))
 		}
-		msg.From = conn.username
-		mq <- msg
-		fmt.Fprintf(common.ColorOutput, "%s to %s: %s\n", common.NameColor(conn.username), common.NameColor(msg.To), common.MessageColor(msg.Content))
 	}
 
 	conn.conn.Close()
-	delete(connections, conn.username)
+	connections.Delete(conn.username)
+	rooms.LeaveAll(conn.username)
+	conn.state.closeOnce(conn.outbox)
+	if cluster != nil {
+		cluster.Leave(conn.username)
+	}
 	fmt.Fprintf(common.ColorOutput, "User %s disconnected or kicked\n", common.NameColor(conn.username))
 
 }
 
+// handle_command applies a join/leave/rooms Command from conn to rooms,
+// replying to the client where a reply is expected.
+func handle_command(rooms *Rooms, conn Connection, cmd Command) {
+	switch cmd.Action {
+	case "join":
+		rooms.Join(cmd.Room, conn)
+	case "leave":
+		rooms.Leave(cmd.Room, conn.username)
+	case "rooms":
+		enqueue(conn, common.FrameTypeRoomList, RoomList{rooms.Names(conn.username)})
+	default:
+		enqueue_error(conn, fmt.Sprintf("Unrecognized command '%s'\n", cmd.Action))
+	}
+}
+
 // A utility function that sends an error message
 // from server to client.
 func send_error(conn net.Conn, error_msg string) {
 	msg := Message{"", "", error_msg, true}
-	enc := gob.NewEncoder(conn)
-	err := enc.Encode(msg)
+	err := send_frame(conn, common.FrameTypeError, msg)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
 /*
-* A function that continually processes the message queue.
-* Pulls messages from the queue and checks their source and destination
-* fields. If both source and destination clients have disconnected the
-function drops the message. If the destination client is not connected
-the function sends an error message to the source client and drops the message.
-If all checks pass, the function sends the message to the destination client.
+* A pure router that continually processes the message queue. Pulls messages
+* from the queue and checks their source and destination fields, then
+* enqueues the message onto the destination's (or, for a room, every
+* member's) outbound channel for its writer goroutine to deliver. Never
+* writes to a connection itself, so a slow destination can only ever back up
+* its own queue, not this goroutine. If the destination is a room (To starts
+* with "#"), the message is fanned out to every member of that room.
+* Otherwise, if both source and destination clients have disconnected the
+* function drops the message. If the destination client is not connected the
+* function sends an error message to the source client and drops the message.
+* A message from a muted sender is silently dropped, with a notice sent back
+* to the sender instead of being delivered.
+*
+* If this server is part of a cluster and the destination user isn't one of
+* connections, the message is forwarded over a persistent TCP link to the
+* node the cluster's gossip layer believes owns that user, rather than
+* immediately being reported as undelivered.
 */
-func process_message_queue(connections map[string]Connection, mq <-chan Message) {
+func process_message_queue(connections *ConnTable, mq <-chan Message, rooms *Rooms, bans *moderation.List, cluster *federation.Cluster) {
 	for {
 		msg, ok := <-mq
 
@@ -144,27 +426,58 @@ func process_message_queue(connections map[string]Connection, mq <-chan Message)
 			return
 		}
 
-		to, ok := connections[msg.To]
+		if bans.IsMuted(msg.From) {
+			if from, ok := connections.Get(msg.From); ok {
+				enqueue_error(from, "You are muted and cannot send messages right now\n")
+			}
+			continue
+		}
+
+		if strings.HasPrefix(msg.To, "#") {
+			members, ok := rooms.Members(msg.To)
+
+			if !ok {
+				if from, ok := connections.Get(msg.From); ok {
+					enqueue_error(from, fmt.Sprintf("'%s' does not exist\n", msg.To))
+				}
+				continue
+			}
+
+			for _, member := range members {
+				if member.username == msg.From {
+					continue
+				}
+				enqueue(member, common.FrameTypeMessage, msg)
+			}
+			continue
+		}
+
+		to, ok := connections.Get(msg.To)
 
 		if !ok {
+			if cluster != nil {
+				if node_id, addr, ok := cluster.Owner(msg.To); ok {
+					if err := forward_message(cluster, node_id, addr, msg); err == nil {
+						continue
+					}
+				}
+			}
+
 			fmt.Fprintf(common.ColorOutput, "User %s does not exist\n", common.NameColor(msg.To))
 
-			from, ok := connections[msg.From]
+			from, ok := connections.Get(msg.From)
 			// Obscure edge case in which a sender disconnects immediately after sending a message, but before the message
 			// is delivered. `connections` is shared among threads so another thread could delete a sender
-			// before this thread has a chance to process the message.dec
+			// before this thread has a chance to process the message.
 			if !ok {
 				fmt.Fprintf(common.ColorOutput, "Sender %s does not exist either. Dropping message\n", common.NameColor(msg.From))
 				continue
 			}
-			send_error(from.conn, fmt.Sprintf("'%s' is not connected\n", msg.To))
+			enqueue_error(from, fmt.Sprintf("'%s' is not connected\n", msg.To))
 			continue
 		}
-		enc := gob.NewEncoder(to.conn)
-		err := enc.Encode(msg)
-		if err != nil {
-			log.Fatal(err)
-		}
+
+		enqueue(to, common.FrameTypeMessage, msg)
 	}
 }
 
@@ -175,67 +488,251 @@ func process_message_queue(connections map[string]Connection, mq <-chan Message)
 * the server saves the client's connection and starts
 a new goroutine to process the source client's messages.
 */
-func listen_for_connections(ln net.Listener, connections map[string]Connection, mq chan<- Message) {
+func listen_for_connections(ln net.Listener, connections *ConnTable, mq chan<- Message, fingerprints *FingerprintStore, rooms *Rooms, bans *moderation.List, cluster *federation.Cluster) {
 	for {
-		conn, err := receive_connection(ln)
+		conn, err := receive_connection(ln, fingerprints, bans)
 
 		if err != nil {
 			fmt.Println(err)
 			continue
 		}
 
-		_, ok := connections[conn.username]
+		if cluster != nil && cluster.OwnedByPeer(conn.username) {
+			send_error(conn.conn, "Username is taken\n")
+			conn.conn.Close()
+			continue
+		}
 
-		if ok {
+		if !connections.Register(conn) {
 			send_error(conn.conn, "Username is taken\n")
 			conn.conn.Close()
 			continue
 		}
 
-		connections[conn.username] = conn
-		go receive_messages(connections, conn, mq)
+		if cluster != nil {
+			cluster.Join(conn.username)
+		}
+		go write_loop(conn)
+		go receive_messages(connections, conn, mq, rooms, cluster)
 	}
 }
 
+// ServerState bundles together everything startServer wires up, so that a
+// caller driving an additional listener alongside the plain TCP one (e.g.
+// the gateway subcommand's websocket endpoint) can plug into the exact same
+// connections map, rooms, message queue, and moderation list.
+type ServerState struct {
+	connections   *ConnTable
+	message_queue chan Message
+	rooms         *Rooms
+	bans          *moderation.List
+	console       *AdminConsole
+	cluster       *federation.Cluster
+}
+
+// clusterConfig holds the flags needed to join this server to a federation
+// cluster. node_id is left empty to disable clustering entirely.
+type clusterConfig struct {
+	node_id      string
+	gossip_addr  string
+	forward_addr string
+	seeds        []string
+}
+
 /*
-* Main thread, initializes the message queue
-* as well as the map from client usernames to messages.
-* The function starts two goroutines one to listen
-* for connections and another to process the message queue
-* the function then waits for an 'exit' command from the user
- */
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Need to supply listening port for incoming connections")
-		return
+startServer wires up the shared server state, starts listening for TCP
+connections on listen_port, and starts the message queue router and admin
+console goroutines. It returns before blocking so that callers (main or the
+gateway subcommand) can attach additional listeners before handing off to
+the admin stdin loop.
+*/
+func startServer(listen_port int, cert_file string, key_file string, ca_file string, fingerprint_db string, moderation_db string, admin_port int, admin_secret string, cc clusterConfig) *ServerState {
+	connections := NewConnTable()
+	message_queue := make(chan Message, 256)
+	rooms := NewRooms()
+
+	bans, err := moderation.Load(moderation_db)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	listen_port, err := strconv.Atoi(os.Args[1])
+	var ln net.Listener
+	var fingerprints *FingerprintStore
 
-	if err != nil {
-		panic(err)
+	if cert_file != "" || key_file != "" {
+		tls_config, err := common.BuildServerTLSConfig(cert_file, key_file, ca_file)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ln, err = tls.Listen("tcp", fmt.Sprintf(":%d", listen_port), tls_config)
+		if err != nil {
+			panic(err)
+		}
+
+		fingerprints, err = LoadFingerprintStore(fingerprint_db)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		ln, err = net.Listen("tcp", fmt.Sprintf(":%d", listen_port))
+		if err != nil {
+			panic(err)
+		}
 	}
 
-	connections := make(map[string]Connection)
-	message_queue := make(chan Message, 256)
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", listen_port))
+	var cluster *federation.Cluster
+	if cc.node_id != "" {
+		cluster, err = federation.NewCluster(cc.node_id, cc.gossip_addr, cc.forward_addr, cc.seeds)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	if err != nil {
-		panic(err)
+		forward_ln, err := net.Listen("tcp", cc.forward_addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go listen_for_federated_connections(forward_ln, message_queue)
+
+		// If gossip later learns that another node won an ownership conflict
+		// over one of our local users (e.g. the same username connected to
+		// two nodes during a partition), the local connection is now stale:
+		// disconnect it and tell it why, rather than leaving it believing it
+		// still owns the username.
+		cluster.OnConflict(func(username string) {
+			if conn, ok := connections.Get(username); ok {
+				enqueue_error(conn, fmt.Sprintf("Your session for %s was claimed by another node in the cluster\n", username))
+				conn.conn.Close()
+			}
+		})
+
+		fmt.Fprintf(common.ColorOutput, "Joined cluster as node %s\n", common.NameColor(cc.node_id))
 	}
 
-	go process_message_queue(connections, message_queue)
+	go process_message_queue(connections, message_queue, rooms, bans, cluster)
 	fmt.Printf("Listening for connections\n")
 
-	go listen_for_connections(ln, connections, message_queue)
+	go listen_for_connections(ln, connections, message_queue, fingerprints, rooms, bans, cluster)
+
+	console := NewAdminConsole(connections, bans)
 
+	if admin_port != 0 {
+		if admin_secret == "" {
+			log.Fatal("-admin-secret is required when -admin-port is set")
+		}
+		go listen_admin(admin_port, admin_secret, console)
+	}
+
+	return &ServerState{connections, message_queue, rooms, bans, console, cluster}
+}
+
+// run_admin_stdin_loop reads admin commands from stdin until an 'exit' command is given.
+func run_admin_stdin_loop(console *AdminConsole) {
 	scanner := bufio.NewScanner(os.Stdin)
 
 	for scanner.Scan() {
 		if scanner.Text() == "exit" {
 			os.Exit(0)
 		} else {
-			fmt.Println("Unrecognized command. Type 'exit' to quit")
+			console.Run(scanner.Text(), os.Stdout)
 		}
 	}
 }
+
+// server_flags declares the flags common to both the plain TCP server and
+// the gateway subcommand, returning the parsed values.
+func server_flags(fs *flag.FlagSet) (cert_file, key_file, ca_file, fingerprint_db, moderation_db *string, admin_port *int, admin_secret *string) {
+	cert_file = fs.String("cert", "", "path to the server's TLS certificate (enables TLS, along with -key)")
+	key_file = fs.String("key", "", "path to the private key matching -cert")
+	ca_file = fs.String("ca", "", "path to a CA bundle used to verify client certificates presented for pinning")
+	fingerprint_db = fs.String("fingerprint-db", "fingerprints.json", "path to the JSON file that persists certificate fingerprint -> username bindings")
+	moderation_db = fs.String("moderation-db", "moderation.json", "path to the JSON file that persists bans and mutes")
+	admin_port = fs.Int("admin-port", 0, "port to listen on for remote admin connections (0 disables the remote admin console)")
+	admin_secret = fs.String("admin-secret", "", "shared secret a remote admin connection must send before its commands are accepted")
+	return
+}
+
+// cluster_flags declares the flags that join this server to a federation
+// cluster, returning the parsed values. Clustering is disabled unless
+// -node-id is set.
+func cluster_flags(fs *flag.FlagSet) (node_id, gossip_addr, forward_addr, seeds *string) {
+	node_id = fs.String("node-id", "", "this node's unique ID within the cluster (enables federation)")
+	gossip_addr = fs.String("gossip-addr", ":7946", "UDP address other nodes gossip membership with")
+	forward_addr = fs.String("forward-addr", ":7947", "TCP address other nodes forward messages to")
+	seeds = fs.String("seeds", "", "comma-separated gossip addresses of one or more existing cluster members")
+	return
+}
+
+func parse_cluster_config(node_id, gossip_addr, forward_addr, seeds string) clusterConfig {
+	var seed_list []string
+	if seeds != "" {
+		seed_list = strings.Split(seeds, ",")
+	}
+
+	return clusterConfig{node_id, gossip_addr, forward_addr, seed_list}
+}
+
+// run_server runs the plain TCP chat server and blocks on the admin stdin loop.
+func run_server(args []string) {
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	cert_file, key_file, ca_file, fingerprint_db, moderation_db, admin_port, admin_secret := server_flags(fs)
+	node_id, gossip_addr, forward_addr, seeds := cluster_flags(fs)
+	fs.Parse(args)
+
+	pos_args := fs.Args()
+	if len(pos_args) < 1 {
+		fmt.Println("Need to supply listening port for incoming connections")
+		return
+	}
+
+	listen_port, err := strconv.Atoi(pos_args[0])
+	if err != nil {
+		panic(err)
+	}
+
+	cc := parse_cluster_config(*node_id, *gossip_addr, *forward_addr, *seeds)
+	state := startServer(listen_port, *cert_file, *key_file, *ca_file, *fingerprint_db, *moderation_db, *admin_port, *admin_secret, cc)
+	run_admin_stdin_loop(state.console)
+}
+
+// run_gateway runs the chat server alongside an HTTP/WebSocket gateway so
+// browsers can join the same chat as TCP clients, and blocks on the admin
+// stdin loop.
+func run_gateway(args []string) {
+	fs := flag.NewFlagSet("gateway", flag.ExitOnError)
+	cert_file, key_file, ca_file, fingerprint_db, moderation_db, admin_port, admin_secret := server_flags(fs)
+	node_id, gossip_addr, forward_addr, seeds := cluster_flags(fs)
+	http_port := fs.Int("http-port", 8080, "port for the HTTP/WebSocket gateway")
+	fs.Parse(args)
+
+	pos_args := fs.Args()
+	if len(pos_args) < 1 {
+		fmt.Println("Need to supply listening port for incoming connections")
+		return
+	}
+
+	listen_port, err := strconv.Atoi(pos_args[0])
+	if err != nil {
+		panic(err)
+	}
+
+	cc := parse_cluster_config(*node_id, *gossip_addr, *forward_addr, *seeds)
+	state := startServer(listen_port, *cert_file, *key_file, *ca_file, *fingerprint_db, *moderation_db, *admin_port, *admin_secret, cc)
+	go serve_gateway(*http_port, state)
+	run_admin_stdin_loop(state.console)
+}
+
+/*
+* Main thread. Dispatches to the gateway subcommand when the first argument
+* is "gateway", otherwise runs the plain TCP server. Either way, it starts
+* goroutines to listen for connections and process the message queue, then
+* blocks reading admin commands from stdin until an 'exit' command is given.
+ */
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gateway" {
+		run_gateway(os.Args[2:])
+		return
+	}
+
+	run_server(os.Args[1:])
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestConnStateSendAfterClose checks that send reports failure instead of
+// sending once a connState has been closed.
+func TestConnStateSendAfterClose(t *testing.T) {
+	outbox := make(chan outboundFrame, 1)
+	state := &connState{}
+
+	state.closeOnce(outbox)
+
+	if state.send(outbox, outboundFrame{}) {
+		t.Fatal("send succeeded on a closed connState")
+	}
+}
+
+// TestConnStateCloseOnceIsIdempotent checks that closing an already-closed
+// connState doesn't attempt to close outbox a second time, which would panic.
+func TestConnStateCloseOnceIsIdempotent(t *testing.T) {
+	outbox := make(chan outboundFrame, 1)
+	state := &connState{}
+
+	state.closeOnce(outbox)
+	state.closeOnce(outbox)
+}
+
+/*
+TestConnStateSendCloseRace exercises the scenario that used to panic: one
+goroutine repeatedly sending (as enqueue does from process_message_queue)
+racing another goroutine closing the connection (as receive_messages'
+cleanup does on disconnect). Before connState existed, a send losing this
+race would hit "send on closed channel" even inside a select/default. Run
+with -race to additionally confirm there's no data race on the closed flag.
+*/
+func TestConnStateSendCloseRace(t *testing.T) {
+	outbox := make(chan outboundFrame, SendQueueCapacity)
+	state := &connState{}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			state.send(outbox, outboundFrame{})
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		state.closeOnce(outbox)
+	}()
+
+	wg.Wait()
+}
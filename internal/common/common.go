@@ -1,6 +1,13 @@
 package common
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+
 	"github.com/fatih/color"
 )
 
@@ -19,3 +26,78 @@ var ColorOutput = color.Output
 var NameColor = color.New(color.FgGreen).SprintFunc()
 var MessageColor = color.New(color.FgBlue).SprintFunc()
 var ErrorColor = color.New(color.FgRed).SprintFunc()
+
+/*
+Builds a *tls.Config for a client dialing the chat server. certFile/keyFile are
+optional and, when both are set, present a client certificate the server can
+pin to a username. caFile is optional and, when set, is used instead of the
+system root pool to verify the server's certificate.
+*/
+func BuildClientTLSConfig(certFile string, keyFile string, caFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	return cfg, nil
+}
+
+/*
+Builds a *tls.Config for the server. The server certificate/key pair is
+required. If caFile is set, client certificates signed by that CA are
+requested (but not strictly required, since unauthenticated clients are still
+allowed and pinning is enforced separately once a certificate is presented).
+*/
+func BuildServerTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return cfg, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	raw, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", caFile)
+	}
+
+	return pool, nil
+}
+
+// CertFingerprint returns the hex-encoded SHA-256 fingerprint of a client's
+// leaf certificate, used to pin a certificate to a username.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
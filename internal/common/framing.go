@@ -0,0 +1,109 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Frame type tags carried in a frame's header, identifying how the receiver
+// should decode the frame body.
+const (
+	FrameTypeMessage  uint8 = iota // body is a gob-encoded Message
+	FrameTypeError                 // body is a gob-encoded Message with Error set
+	FrameTypeCommand               // body is a gob-encoded Command (join/leave/rooms)
+	FrameTypeRoomList              // body is a gob-encoded RoomList
+)
+
+/*
+MaxMessageLen bounds the size of a single framed payload, defending against a
+peer that announces an unreasonable length and forces the reader to allocate
+a huge buffer. It defaults to 4 KiB and can be raised up to 16 MiB (never
+below 4 KiB), mirroring the min/max frame size ttrpc enforces.
+*/
+var MaxMessageLen uint32 = 4 * 1024
+
+const MinMessageLen uint32 = 4 * 1024
+const MaxAllowedMessageLen uint32 = 16 * 1024 * 1024
+
+// SetMaxMessageLen validates and installs a new MaxMessageLen.
+func SetMaxMessageLen(n uint32) error {
+	if n < MinMessageLen || n > MaxAllowedMessageLen {
+		return fmt.Errorf("max message length must be between %d and %d bytes", MinMessageLen, MaxAllowedMessageLen)
+	}
+
+	MaxMessageLen = n
+	return nil
+}
+
+// frameHeaderLen is the size in bytes of the fixed {msgType uint8, length uint32} header.
+const frameHeaderLen = 1 + 4
+
+var framePool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, MinMessageLen)
+		return &buf
+	},
+}
+
+// WriteFrame writes a {msgType, length} header followed by body to w.
+func WriteFrame(w io.Writer, msgType uint8, body []byte) error {
+	if uint32(len(body)) > MaxMessageLen {
+		return fmt.Errorf("frame body of %d bytes exceeds max message length of %d bytes", len(body), MaxMessageLen)
+	}
+
+	header := make([]byte, frameHeaderLen)
+	header[0] = msgType
+	binary.BigEndian.PutUint32(header[1:], uint32(len(body)))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	_, err := w.Write(body)
+	return err
+}
+
+/*
+ReadFrame reads a single frame from r. The declared length is checked against
+MaxMessageLen before a buffer is allocated, so a peer can't force an
+oversized allocation by lying about the length. The returned body is drawn
+from a pool; callers must return it with PutFrameBuf once they're done
+decoding it.
+*/
+func ReadFrame(r io.Reader) (uint8, []byte, error) {
+	header := make([]byte, frameHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+
+	msgType := header[0]
+	length := binary.BigEndian.Uint32(header[1:])
+
+	if length > MaxMessageLen {
+		return 0, nil, fmt.Errorf("frame length %d exceeds max message length of %d bytes", length, MaxMessageLen)
+	}
+
+	body := getFrameBuf(int(length))
+	if _, err := io.ReadFull(r, body); err != nil {
+		PutFrameBuf(body)
+		return 0, nil, err
+	}
+
+	return msgType, body, nil
+}
+
+func getFrameBuf(n int) []byte {
+	bufPtr := framePool.Get().(*[]byte)
+	buf := *bufPtr
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	return buf[:n]
+}
+
+// PutFrameBuf returns a buffer obtained from ReadFrame to the pool.
+func PutFrameBuf(buf []byte) {
+	framePool.Put(&buf)
+}
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestWriteReadFrameRoundTrip checks that a frame written by WriteFrame is
+// read back by ReadFrame with the same type and body, and that this holds
+// for multiple frames written back-to-back into the same stream (the
+// scenario that broke when gob decoder state was reused across frames).
+func TestWriteReadFrameRoundTrip(t *testing.T) {
+	var stream bytes.Buffer
+
+	frames := []struct {
+		msgType uint8
+		body    []byte
+	}{
+		{FrameTypeMessage, []byte("hello")},
+		{FrameTypeMessage, []byte("world")},
+		{FrameTypeCommand, []byte{}},
+	}
+
+	for _, f := range frames {
+		if err := WriteFrame(&stream, f.msgType, f.body); err != nil {
+			t.Fatalf("WriteFrame(%d, %q): %v", f.msgType, f.body, err)
+		}
+	}
+
+	for _, want := range frames {
+		msgType, body, err := ReadFrame(&stream)
+		if err != nil {
+			t.Fatalf("ReadFrame: %v", err)
+		}
+
+		if msgType != want.msgType {
+			t.Errorf("msgType = %d, want %d", msgType, want.msgType)
+		}
+		if !bytes.Equal(body, want.body) {
+			t.Errorf("body = %q, want %q", body, want.body)
+		}
+
+		PutFrameBuf(body)
+	}
+}
+
+// TestReadFrameRejectsOversizedLength checks that ReadFrame refuses a
+// declared length over MaxMessageLen before allocating a buffer for it.
+func TestReadFrameRejectsOversizedLength(t *testing.T) {
+	var stream bytes.Buffer
+	body := make([]byte, MaxMessageLen+1)
+
+	header := make([]byte, frameHeaderLen)
+	header[0] = FrameTypeMessage
+	header[1] = byte(len(body) >> 24)
+	header[2] = byte(len(body) >> 16)
+	header[3] = byte(len(body) >> 8)
+	header[4] = byte(len(body))
+	stream.Write(header)
+	stream.Write(body)
+
+	if _, _, err := ReadFrame(&stream); err == nil {
+		t.Fatal("ReadFrame accepted a frame longer than MaxMessageLen")
+	}
+}
@@ -0,0 +1,492 @@
+/*
+Package federation lets several chat server processes form a cluster and
+route messages for users connected to a different node. Membership is
+tracked with a lightweight SWIM-style gossip protocol, in the spirit of
+hashicorp/memberlist: each node periodically sends a random peer a UDP
+packet carrying its own digest, a little piggybacked membership and
+user-presence gossip, and drains any pending presence deltas of its own. A
+peer that stays silent for too long is marked suspect, then dead. Every
+Tsync a node also exchanges a full membership and user-ownership snapshot
+with a random peer, to repair gossip that a peer never received.
+
+Ownership conflicts (the same username claimed by two nodes, e.g. after a
+network partition heals) are resolved by incarnation number, the higher
+incarnation winning, with a tie (each node's incarnation counter is local,
+so two independent claims easily collide) broken deterministically by
+NodeID so every node converges on the same winner. The losing node is
+notified via OnConflict so it
+can disconnect its now-stale local client, and a node accepting a new local
+connection checks OwnedByPeer first so it doesn't knowingly race a peer for
+a username gossip already says belongs to it.
+*/
+package federation
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// MemberState is a node's believed liveness, per the SWIM failure detector.
+type MemberState int
+
+const (
+	Alive MemberState = iota
+	Suspect
+	Dead
+)
+
+// Member is what the cluster knows about one node, including itself.
+type Member struct {
+	NodeID      string
+	GossipAddr  string // UDP address other nodes gossip with
+	ForwardAddr string // TCP address other nodes forward Messages to
+	Incarnation uint64
+	State       MemberState
+	LastSeen    time.Time
+}
+
+// userOwner is the node currently believed to host a username, along with
+// the incarnation number that claim was made with.
+type userOwner struct {
+	NodeID      string
+	Incarnation uint64
+}
+
+// packet is the gob-encoded payload exchanged between nodes over UDP. A
+// non-full packet piggybacks the sender's own digest and any pending user
+// deltas; a full packet (sent during anti-entropy) carries the sender's
+// entire membership and ownership table.
+type packet struct {
+	From    string
+	Full    bool
+	Members []memberDigest
+	Users   []userDelta
+}
+
+type memberDigest struct {
+	NodeID      string
+	GossipAddr  string
+	ForwardAddr string
+	Incarnation uint64
+	State       MemberState
+}
+
+// userDelta announces that NodeID claims (or, if Left, is relinquishing)
+// Username as of Incarnation.
+type userDelta struct {
+	Username    string
+	NodeID      string
+	Incarnation uint64
+	Left        bool
+}
+
+// Cluster gossips membership and per-username ownership with a set of peer
+// nodes, and caches the persistent TCP connections used to forward messages
+// to the node that owns their destination user.
+type Cluster struct {
+	mu   sync.Mutex
+	self Member
+	conn *net.UDPConn
+
+	members map[string]*Member   // nodeID -> member, including self
+	owners  map[string]userOwner // username -> owning node
+	pending []userDelta          // presence deltas waiting to be piggybacked
+
+	seedAddrs    []string
+	forwardConns map[string]net.Conn
+
+	incarnationCounter uint64
+	onConflict         func(username string)
+
+	Tsuspect time.Duration
+	Tdead    time.Duration
+	Tgossip  time.Duration
+	Tsync    time.Duration
+}
+
+/*
+NewCluster starts a node with the given ID, gossiping on gossipAddr and
+accepting forwarded messages on forwardAddr, and seeds its membership view
+with the gossip addresses of one or more already-running peers. It starts
+the background gossip, failure-detector, and anti-entropy goroutines before
+returning.
+*/
+func NewCluster(nodeID string, gossipAddr string, forwardAddr string, seeds []string) (*Cluster, error) {
+	udp_addr, err := net.ResolveUDPAddr("udp", gossipAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", udp_addr)
+	if err != nil {
+		return nil, err
+	}
+
+	self := Member{
+		NodeID:      nodeID,
+		GossipAddr:  gossipAddr,
+		ForwardAddr: forwardAddr,
+		Incarnation: 1,
+		State:       Alive,
+		LastSeen:    time.Now(),
+	}
+
+	c := &Cluster{
+		self:         self,
+		conn:         conn,
+		members:      map[string]*Member{nodeID: &self},
+		owners:       make(map[string]userOwner),
+		seedAddrs:    seeds,
+		forwardConns: make(map[string]net.Conn),
+		Tsuspect:     5 * time.Second,
+		Tdead:        15 * time.Second,
+		Tgossip:      time.Second,
+		Tsync:        10 * time.Second,
+	}
+
+	go c.receive_loop()
+	go c.gossip_loop()
+	go c.failure_detector_loop()
+	go c.anti_entropy_loop()
+
+	return c, nil
+}
+
+// Join announces that username is now connected to this node, claiming it
+// with this node's next incarnation number. The counter is local to this
+// node, so a peer's conflicting claim with a higher incarnation (or an equal
+// one from a higher NodeID) still wins; see merge_user_locked.
+func (c *Cluster) Join(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.incarnationCounter++
+	c.owners[username] = userOwner{c.self.NodeID, c.incarnationCounter}
+	c.pending = append(c.pending, userDelta{Username: username, NodeID: c.self.NodeID, Incarnation: c.incarnationCounter})
+}
+
+// Leave relinquishes this node's ownership of username, e.g. when the user disconnects.
+func (c *Cluster) Leave(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	owner, ok := c.owners[username]
+	if !ok || owner.NodeID != c.self.NodeID {
+		return
+	}
+
+	delete(c.owners, username)
+	c.pending = append(c.pending, userDelta{Username: username, NodeID: c.self.NodeID, Incarnation: owner.Incarnation, Left: true})
+}
+
+// Owner reports the node hosting username and the TCP address to forward
+// messages to it, if username is known to belong to a peer rather than
+// this node.
+func (c *Cluster) Owner(username string) (nodeID string, forwardAddr string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	owner, ok := c.owners[username]
+	if !ok || owner.NodeID == c.self.NodeID {
+		return "", "", false
+	}
+
+	member, ok := c.members[owner.NodeID]
+	if !ok || member.ForwardAddr == "" {
+		return "", "", false
+	}
+
+	return owner.NodeID, member.ForwardAddr, true
+}
+
+// OwnedByPeer reports whether username is currently claimed by some other
+// node in the cluster's ownership table, so a node accepting a new local
+// connection can refuse to let it claim a username gossip already says
+// belongs elsewhere rather than silently racing that node for ownership.
+func (c *Cluster) OwnedByPeer(username string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	owner, ok := c.owners[username]
+	return ok && owner.NodeID != c.self.NodeID
+}
+
+/*
+OnConflict registers fn to be called, outside any internal lock, whenever
+gossip informs this node that a peer won an ownership conflict over a
+username this node believed it owned (the two nodes' Join calls raced, e.g.
+across a network partition). fn is expected to disconnect the now-stale
+local client for username and let it know why.
+*/
+func (c *Cluster) OnConflict(fn func(username string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onConflict = fn
+}
+
+// Dial returns a persistent TCP connection to nodeID's forwarding port,
+// dialing it if there isn't one cached yet.
+func (c *Cluster) Dial(nodeID string, addr string) (net.Conn, error) {
+	c.mu.Lock()
+	conn, ok := c.forwardConns[nodeID]
+	c.mu.Unlock()
+
+	if ok {
+		return conn, nil
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.forwardConns[nodeID] = conn
+	c.mu.Unlock()
+
+	return conn, nil
+}
+
+// Drop closes and discards a cached forwarding connection to nodeID, so the
+// next Dial reconnects. Called after a forwarding write fails.
+func (c *Cluster) Drop(nodeID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if conn, ok := c.forwardConns[nodeID]; ok {
+		conn.Close()
+		delete(c.forwardConns, nodeID)
+	}
+}
+
+func (c *Cluster) gossip_loop() {
+	ticker := time.NewTicker(c.Tgossip)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if target := c.pick_gossip_target(); target != "" {
+			c.send_packet(target, false)
+		}
+	}
+}
+
+// anti_entropy_loop periodically exchanges a full membership and ownership
+// snapshot with a random peer, repairing any deltas a gossip round dropped.
+func (c *Cluster) anti_entropy_loop() {
+	ticker := time.NewTicker(c.Tsync)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if target := c.pick_gossip_target(); target != "" {
+			c.send_packet(target, true)
+		}
+	}
+}
+
+// failure_detector_loop marks alive peers that have been silent for longer
+// than Tsuspect as suspect, and suspect or alive peers silent for longer
+// than Tdead as dead.
+func (c *Cluster) failure_detector_loop() {
+	ticker := time.NewTicker(c.Tsuspect / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.mu.Lock()
+		now := time.Now()
+		for id, m := range c.members {
+			if id == c.self.NodeID {
+				continue
+			}
+
+			silence := now.Sub(m.LastSeen)
+			switch {
+			case m.State != Dead && silence > c.Tdead:
+				m.State = Dead
+			case m.State == Alive && silence > c.Tsuspect:
+				m.State = Suspect
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// pick_gossip_target returns the gossip address of a random non-dead peer,
+// falling back to the configured seed addresses if no peer is known yet.
+func (c *Cluster) pick_gossip_target() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var candidates []string
+	for id, m := range c.members {
+		if id != c.self.NodeID && m.State != Dead {
+			candidates = append(candidates, m.GossipAddr)
+		}
+	}
+
+	if len(candidates) == 0 {
+		candidates = c.seedAddrs
+	}
+
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	return candidates[rand.Intn(len(candidates))]
+}
+
+func (c *Cluster) send_packet(addr string, full bool) {
+	c.mu.Lock()
+	pkt := packet{From: c.self.NodeID, Full: full}
+
+	if full {
+		for _, m := range c.members {
+			pkt.Members = append(pkt.Members, memberDigest{m.NodeID, m.GossipAddr, m.ForwardAddr, m.Incarnation, m.State})
+		}
+		for user, owner := range c.owners {
+			pkt.Users = append(pkt.Users, userDelta{Username: user, NodeID: owner.NodeID, Incarnation: owner.Incarnation})
+		}
+	} else {
+		pkt.Members = []memberDigest{{c.self.NodeID, c.self.GossipAddr, c.self.ForwardAddr, c.self.Incarnation, c.self.State}}
+		pkt.Users = c.pending
+		c.pending = nil
+	}
+	c.mu.Unlock()
+
+	udp_addr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(pkt); err != nil {
+		return
+	}
+
+	c.conn.WriteToUDP(buf.Bytes(), udp_addr)
+}
+
+func (c *Cluster) receive_loop() {
+	buf := make([]byte, 64*1024)
+
+	for {
+		n, addr, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		var pkt packet
+		if err := gob.NewDecoder(bytes.NewReader(buf[:n])).Decode(&pkt); err != nil {
+			continue
+		}
+
+		c.merge_packet(pkt, addr.String())
+	}
+}
+
+func (c *Cluster) merge_packet(pkt packet, source_addr string) {
+	c.mu.Lock()
+
+	if pkt.From != c.self.NodeID {
+		if m, ok := c.members[pkt.From]; ok {
+			m.State = Alive
+			m.LastSeen = time.Now()
+		} else {
+			c.members[pkt.From] = &Member{NodeID: pkt.From, GossipAddr: source_addr, State: Alive, LastSeen: time.Now()}
+		}
+	}
+
+	for _, d := range pkt.Members {
+		c.merge_member_locked(d)
+	}
+
+	var conflicts []string
+	for _, u := range pkt.Users {
+		if lost := c.merge_user_locked(u); lost != "" {
+			conflicts = append(conflicts, lost)
+		}
+	}
+
+	onConflict := c.onConflict
+	c.mu.Unlock()
+
+	// Notified outside the lock: onConflict runs arbitrary caller code (in
+	// practice, disconnecting a local client), which must not be called
+	// while c.mu is held since it could call back into the Cluster (e.g.
+	// Leave) and deadlock on a non-reentrant mutex.
+	if onConflict != nil {
+		for _, username := range conflicts {
+			onConflict(username)
+		}
+	}
+}
+
+func (c *Cluster) merge_member_locked(d memberDigest) {
+	if d.NodeID == c.self.NodeID {
+		return
+	}
+
+	existing, ok := c.members[d.NodeID]
+	if !ok {
+		c.members[d.NodeID] = &Member{d.NodeID, d.GossipAddr, d.ForwardAddr, d.Incarnation, d.State, time.Now()}
+		return
+	}
+
+	if d.Incarnation > existing.Incarnation {
+		*existing = Member{d.NodeID, d.GossipAddr, d.ForwardAddr, d.Incarnation, d.State, time.Now()}
+		return
+	}
+
+	if d.Incarnation == existing.Incarnation && d.State > existing.State {
+		existing.State = d.State
+	}
+	if d.ForwardAddr != "" {
+		existing.ForwardAddr = d.ForwardAddr
+	}
+}
+
+/*
+merge_user_locked applies a user-ownership delta, keeping the claim with the
+higher incarnation number. u must be applied while c.mu is held.
+
+incarnationCounter is local to each node, so two nodes can easily produce
+the same incarnation number for independent claims on the same username
+(most obviously: every node's very first Join is incarnation 1). A tied
+incarnation is broken deterministically by NodeID so every node in the
+cluster converges on the same winner instead of each one keeping whichever
+claim it happened to see first.
+
+If the delta overrides this node's own claim to u.Username with a different
+node's winning claim, the local client for that username just lost an
+ownership conflict (two nodes' Join calls raced for the same username);
+merge_user_locked returns u.Username so the caller can notify it once c.mu
+is released. Returns "" when nothing local was lost.
+*/
+func (c *Cluster) merge_user_locked(u userDelta) (lostUsername string) {
+	existing, ok := c.owners[u.Username]
+
+	if u.Left {
+		if ok && u.Incarnation >= existing.Incarnation {
+			delete(c.owners, u.Username)
+		}
+		return ""
+	}
+
+	wins := !ok ||
+		u.Incarnation > existing.Incarnation ||
+		(u.Incarnation == existing.Incarnation && u.NodeID > existing.NodeID)
+
+	if wins {
+		lostLocally := ok && existing.NodeID == c.self.NodeID && u.NodeID != c.self.NodeID
+		c.owners[u.Username] = userOwner{u.NodeID, u.Incarnation}
+		if lostLocally {
+			return u.Username
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,75 @@
+package federation
+
+import "testing"
+
+// newTestCluster builds a Cluster with just enough state for
+// merge_user_locked to operate on, without starting any network goroutines.
+func newTestCluster(nodeID string) *Cluster {
+	return &Cluster{
+		self:   Member{NodeID: nodeID},
+		owners: make(map[string]userOwner),
+	}
+}
+
+func TestMergeUserLockedHigherIncarnationWins(t *testing.T) {
+	c := newTestCluster("node-a")
+	c.owners["alice"] = userOwner{"node-a", 1}
+
+	lost := c.merge_user_locked(userDelta{Username: "alice", NodeID: "node-b", Incarnation: 2})
+
+	if lost != "alice" {
+		t.Fatalf("lostUsername = %q, want %q", lost, "alice")
+	}
+	if owner := c.owners["alice"]; owner.NodeID != "node-b" {
+		t.Fatalf("alice should now be owned by node-b, got %+v", owner)
+	}
+}
+
+/*
+TestMergeUserLockedTieBrokenDeterministically covers two nodes independently
+Join-ing the same username with the same incarnation number, which
+incarnationCounter being purely local makes easy (e.g. every node's very
+first Join is incarnation 1). Without a deterministic tiebreak, each node
+kept whichever claim it saw first and never converged; with it, both nodes
+must land on the same winner regardless of which side is applying the
+delta.
+*/
+func TestMergeUserLockedTieBrokenDeterministically(t *testing.T) {
+	deltaFromA := userDelta{Username: "alice", NodeID: "node-a", Incarnation: 1}
+	deltaFromB := userDelta{Username: "alice", NodeID: "node-b", Incarnation: 1}
+
+	nodeAsView := newTestCluster("node-a")
+	nodeAsView.owners["alice"] = userOwner{"node-a", 1}
+	nodeAsView.merge_user_locked(deltaFromB)
+
+	nodeBsView := newTestCluster("node-b")
+	nodeBsView.owners["alice"] = userOwner{"node-b", 1}
+	nodeBsView.merge_user_locked(deltaFromA)
+
+	got, want := nodeAsView.owners["alice"].NodeID, nodeBsView.owners["alice"].NodeID
+	if got != want {
+		t.Fatalf("nodes disagree on the tie-break winner: node-a's view=%q, node-b's view=%q", got, want)
+	}
+}
+
+func TestMergeUserLockedLeftRemovesCurrentIncarnation(t *testing.T) {
+	c := newTestCluster("node-a")
+	c.owners["alice"] = userOwner{"node-a", 3}
+
+	c.merge_user_locked(userDelta{Username: "alice", NodeID: "node-a", Incarnation: 3, Left: true})
+
+	if _, ok := c.owners["alice"]; ok {
+		t.Fatal("alice should have been removed by a Left delta at the same incarnation")
+	}
+}
+
+func TestMergeUserLockedLeftIgnoresStaleIncarnation(t *testing.T) {
+	c := newTestCluster("node-a")
+	c.owners["alice"] = userOwner{"node-b", 2}
+
+	c.merge_user_locked(userDelta{Username: "alice", NodeID: "node-a", Incarnation: 1, Left: true})
+
+	if owner, ok := c.owners["alice"]; !ok || owner.NodeID != "node-b" {
+		t.Fatalf("a stale Left delta should not remove a newer claim, got (%+v, %v)", owner, ok)
+	}
+}
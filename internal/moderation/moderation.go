@@ -0,0 +1,169 @@
+// Package moderation persists the server's bans and mutes so that they
+// survive a restart, and evaluates them lazily (at lookup time) rather than
+// through a background sweep.
+package moderation
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// BanTarget identifies what a Ban's Value is matched against.
+type BanTarget string
+
+const (
+	BanName        BanTarget = "name"
+	BanIP          BanTarget = "ip"
+	BanFingerprint BanTarget = "fingerprint"
+)
+
+// Ban is a persisted ban on a username, IP, or certificate fingerprint.
+// A zero Expires means the ban never expires.
+type Ban struct {
+	Target  BanTarget
+	Value   string
+	Expires time.Time
+}
+
+func (b Ban) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+// Mute silences a username's messages until Expires.
+type Mute struct {
+	Username string
+	Expires  time.Time
+}
+
+func (m Mute) expired(now time.Time) bool {
+	return !m.Expires.IsZero() && now.After(m.Expires)
+}
+
+// List is the server's persisted moderation state. It's reloaded from disk
+// on startup and rewritten to disk every time it changes.
+type List struct {
+	mu   sync.Mutex
+	path string
+
+	Bans  []Ban
+	Mutes []Mute
+}
+
+// Load reads the JSON moderation file at path if it exists, or starts with
+// an empty list if it does not.
+func Load(path string) (*List, error) {
+	list := &List{path: path}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return list, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(raw, list); err != nil {
+		return nil, fmt.Errorf("failed to parse moderation list %s: %w", path, err)
+	}
+
+	return list, nil
+}
+
+func (l *List) save() error {
+	raw, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(l.path, raw, 0600)
+}
+
+// Ban adds a ban on target/value that expires after duration. A duration of
+// zero never expires.
+func (l *List) Ban(target BanTarget, value string, duration time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var expires time.Time
+	if duration > 0 {
+		expires = time.Now().Add(duration)
+	}
+
+	l.Bans = append(l.Bans, Ban{target, value, expires})
+	return l.save()
+}
+
+// Unban removes every ban on target/value.
+func (l *List) Unban(target BanTarget, value string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	kept := l.Bans[:0]
+	for _, b := range l.Bans {
+		if b.Target != target || b.Value != value {
+			kept = append(kept, b)
+		}
+	}
+
+	l.Bans = kept
+	return l.save()
+}
+
+// IsBanned reports whether name, ip, or fingerprint matches an unexpired
+// ban. Any of the three may be empty if it doesn't apply (e.g. no client
+// certificate was presented).
+func (l *List) IsBanned(name string, ip string, fingerprint string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for _, b := range l.Bans {
+		if b.expired(now) {
+			continue
+		}
+
+		switch b.Target {
+		case BanName:
+			if name != "" && b.Value == name {
+				return true
+			}
+		case BanIP:
+			if ip != "" && b.Value == ip {
+				return true
+			}
+		case BanFingerprint:
+			if fingerprint != "" && b.Value == fingerprint {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Mute silences username's messages for duration.
+func (l *List) Mute(username string, duration time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.Mutes = append(l.Mutes, Mute{username, time.Now().Add(duration)})
+	return l.save()
+}
+
+// IsMuted reports whether username is currently muted.
+func (l *List) IsMuted(username string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for _, m := range l.Mutes {
+		if m.Username == username && !m.expired(now) {
+			return true
+		}
+	}
+
+	return false
+}
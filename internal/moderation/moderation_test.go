@@ -0,0 +1,82 @@
+package moderation
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestList(t *testing.T) *List {
+	t.Helper()
+
+	list, err := Load(filepath.Join(t.TempDir(), "moderation.json"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return list
+}
+
+func TestBanExpiry(t *testing.T) {
+	list := newTestList(t)
+
+	if err := list.Ban(BanName, "alice", time.Millisecond); err != nil {
+		t.Fatalf("Ban: %v", err)
+	}
+
+	if !list.IsBanned("alice", "", "") {
+		t.Fatal("alice should be banned immediately after Ban")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if list.IsBanned("alice", "", "") {
+		t.Fatal("alice's ban should have expired")
+	}
+}
+
+func TestBanNeverExpiresWithZeroDuration(t *testing.T) {
+	list := newTestList(t)
+
+	if err := list.Ban(BanIP, "10.0.0.1", 0); err != nil {
+		t.Fatalf("Ban: %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if !list.IsBanned("", "10.0.0.1", "") {
+		t.Fatal("a zero-duration ban should never expire")
+	}
+}
+
+func TestUnban(t *testing.T) {
+	list := newTestList(t)
+
+	if err := list.Ban(BanFingerprint, "deadbeef", 0); err != nil {
+		t.Fatalf("Ban: %v", err)
+	}
+	if err := list.Unban(BanFingerprint, "deadbeef"); err != nil {
+		t.Fatalf("Unban: %v", err)
+	}
+
+	if list.IsBanned("", "", "deadbeef") {
+		t.Fatal("fingerprint should no longer be banned after Unban")
+	}
+}
+
+func TestMuteExpiry(t *testing.T) {
+	list := newTestList(t)
+
+	if err := list.Mute("bob", 10*time.Millisecond); err != nil {
+		t.Fatalf("Mute: %v", err)
+	}
+
+	if !list.IsMuted("bob") {
+		t.Fatal("bob should be muted immediately after Mute")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if list.IsMuted("bob") {
+		t.Fatal("bob's mute should have expired")
+	}
+}